@@ -0,0 +1,426 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dexpreopt
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"android/soong/android"
+)
+
+// This file contains code for handling class loader context for dexpreopt. Class loader context
+// is a class loader tree (each library has a class loader, which may have parent and shared
+// library class loaders) that the dynamic linker uses at runtime; dex2oat peeks into it to
+// decide whether it is safe to use the AOT-compiled code from a .odex file.
+//
+// The context is kept as per-conditional-SDK-version lists of top-level libraries, each of which
+// may carry its own nested subcontexts. For the dex2oat command line each list becomes one
+// PCL[...]#PCL[...] clause of the "--host/target-context-for-sdk" option, with a library's
+// subcontexts nested as a "{...}" group after its PCL[...] entry.
+
+// AnySdkVersion means that a library does not require a particular SDK level for its compatibility
+// library, or, equivalently, that is it a part of the unconditional ("any SDK version") context.
+const AnySdkVersion int = 10000 // current
+
+// Compatibility libraries that some apps have historically relied on despite these libraries not
+// being part of the public API. Each one, if needed, is added to the class loader context as a
+// runtime dependency, sometimes gated by the SDK version of the device it will run on.
+const (
+	AndroidHidlManager = "android.hidl.manager-V1.0-java"
+	AndroidHidlBase    = "android.hidl.base-V1.0-java"
+	AndroidTestMock    = "android.test.mock"
+	AndroidTestRunner  = "android.test.runner"
+)
+
+// UnknownInstallLibraryPaths are default on-device install paths for compatibility libraries
+// whose callers do not know (and do not need to track) their install location, because it is
+// always the same for a given library.
+var UnknownInstallLibraryPaths = map[string]string{
+	AndroidHidlManager: "/system/framework/" + AndroidHidlManager + ".jar",
+	AndroidHidlBase:    "/system/framework/" + AndroidHidlBase + ".jar",
+	AndroidTestMock:    "/system/framework/" + AndroidTestMock + ".jar",
+}
+
+// LibraryPath contains the build-time (host) and install-time (device) dex jar paths of a
+// <uses-library> known to a module, as gathered from its dependencies.
+type LibraryPath struct {
+	Host   android.Path
+	Device string
+
+	// IsSharedLibrary is true if this library is a shared (SDK) library: one that advertises its
+	// own <uses-library> requirements via its manifest, so dependent apps must not redeclare them.
+	IsSharedLibrary bool
+
+	// Subcontexts holds this library's own <uses-library> dependencies (for example the static
+	// libs bundled inside a prebuilt AAR), as attached via AddLibraryPathWithSubcontexts.
+	Subcontexts LibraryPaths
+}
+
+// LibraryPaths is a map from library name to its dex jar paths, used to resolve <uses-library>
+// names added to a classLoaderContextMap into actual paths.
+type LibraryPaths map[string]*LibraryPath
+
+// AddLibraryPath adds a library path to the map. It is used for libraries that are always
+// expected to have both their build and install paths known.
+func (lp LibraryPaths) AddLibraryPath(ctx android.ModuleInstallPathContext, lib string, hostPath android.Path, installPath android.InstallPath) {
+	if err := lp.addLibraryPath(ctx, lib, hostPath, installPath, false, true); err != nil {
+		android.ReportPathErrorf(ctx, "%s", err)
+	}
+}
+
+// AddSharedLibraryPath is like AddLibraryPath, but marks the library as a shared (SDK) library,
+// so that its own transitive <uses-library> dependencies are not redeclared by its dependents.
+func (lp LibraryPaths) AddSharedLibraryPath(ctx android.ModuleInstallPathContext, lib string, hostPath android.Path, installPath android.InstallPath) {
+	if err := lp.addLibraryPath(ctx, lib, hostPath, installPath, true, true); err != nil {
+		android.ReportPathErrorf(ctx, "%s", err)
+	}
+}
+
+// MaybeAddLibraryPath adds a library path to the map if the library name is not nil. Unlike
+// AddLibraryPath, it does not fail if the paths are unknown -- it simply does not add the
+// library, deferring the "missing path" error to whatever later tries to look it up.
+func (lp LibraryPaths) MaybeAddLibraryPath(ctx android.ModuleInstallPathContext, lib *string, hostPath android.Path, installPath android.InstallPath) {
+	if lib != nil {
+		lp.addLibraryPath(ctx, *lib, hostPath, installPath, false, false)
+	}
+}
+
+// AddLibraryPathWithSubcontexts is like AddLibraryPath, but also attaches the library's own
+// nested <uses-library> dependencies (for example the static libs bundled inside a prebuilt AAR
+// that itself declares <uses-library> tags), so that the real dependency tree is reflected in
+// the class loader context rather than flattened.
+func (lp LibraryPaths) AddLibraryPathWithSubcontexts(ctx android.ModuleInstallPathContext, lib string, hostPath android.Path, installPath android.InstallPath, nested LibraryPaths) {
+	if err := lp.addLibraryPath(ctx, lib, hostPath, installPath, false, true); err != nil {
+		android.ReportPathErrorf(ctx, "%s", err)
+	}
+	if p, ok := lp[lib]; ok {
+		p.Subcontexts = nested
+	}
+}
+
+// AddLibraryPaths merges another LibraryPaths map into this one.
+func (lp LibraryPaths) AddLibraryPaths(other LibraryPaths) {
+	for lib, path := range other {
+		lp[lib] = path
+	}
+}
+
+func (lp LibraryPaths) addLibraryPath(ctx android.ModuleInstallPathContext, lib string, hostPath android.Path, installPath android.InstallPath, isSharedLibrary, strict bool) error {
+	if hostPath == nil {
+		if strict {
+			return fmt.Errorf("unknown build path to <uses-library> '%s'", lib)
+		}
+		return nil
+	}
+
+	var device string
+	if installPath != nil {
+		device = android.InstallPathToOnDevicePath(ctx, installPath)
+	} else if defaultPath, ok := UnknownInstallLibraryPaths[lib]; ok {
+		device = defaultPath
+	} else if strict {
+		return fmt.Errorf("unknown install path to <uses-library> '%s'", lib)
+	} else {
+		return nil
+	}
+
+	lp[lib] = &LibraryPath{Host: hostPath, Device: device, IsSharedLibrary: isSharedLibrary}
+	return nil
+}
+
+// ClassLoaderContext is a node of a class loader context tree: one library (by name) together
+// with its build/install paths, and the (nested) class loader context of its own dependencies.
+type ClassLoaderContext struct {
+	Name string
+
+	Host   android.Path
+	Device string
+
+	// IsSharedLibrary is true if this library is a shared (SDK) library. Shared libraries
+	// advertise their own <uses-library> requirements via their manifest, so the libraries
+	// nested under Subcontexts must not be redeclared in a dependent app's manifest (see
+	// classLoaderContextMap.usesLibs), even though they still participate in the dex2oat class
+	// loader context.
+	IsSharedLibrary bool
+
+	// Subcontexts is the nested class loader context of this library's own dependencies (for
+	// example, the static libs bundled inside a prebuilt AAR that itself declares
+	// <uses-library> tags). It is rendered as a "{...}" group nested inside this library's
+	// "PCL[...]" entry in the dex2oat class loader context string.
+	Subcontexts []*ClassLoaderContext
+}
+
+// classLoaderContextMap maps a conditional SDK version (or AnySdkVersion) to the ordered list of
+// libraries that must be present in the class loader context at that SDK level.
+type classLoaderContextMap map[int][]*ClassLoaderContext
+
+// addLibs resolves each of the given library names against the module's LibraryPaths and
+// appends the corresponding class loader context nodes to the given SDK version bucket.
+func (m classLoaderContextMap) addLibs(ctx android.ModuleInstallPathContext, sdkVer int, module *ModuleConfig, libs ...string) (bool, error) {
+	for _, lib := range libs {
+		p, ok := module.LibraryPaths[lib]
+		if !ok {
+			return false, fmt.Errorf("dexpreopt cannot find path for <uses-library> '%s'", lib)
+		}
+		m[sdkVer] = append(m[sdkVer], newClassLoaderContext(lib, p))
+	}
+	return true, nil
+}
+
+// newClassLoaderContext builds a class loader context node for the given library, recursively
+// expanding any nested subcontexts attached via AddLibraryPathWithSubcontexts. Subcontexts are
+// visited in sorted name order, since LibraryPaths is a map and therefore has no iteration order
+// of its own.
+func newClassLoaderContext(name string, p *LibraryPath) *ClassLoaderContext {
+	clc := &ClassLoaderContext{
+		Name:            name,
+		Host:            p.Host,
+		Device:          p.Device,
+		IsSharedLibrary: p.IsSharedLibrary,
+	}
+
+	if len(p.Subcontexts) > 0 {
+		names := make([]string, 0, len(p.Subcontexts))
+		for sub := range p.Subcontexts {
+			names = append(names, sub)
+		}
+		sort.Strings(names)
+
+		for _, sub := range names {
+			clc.Subcontexts = append(clc.Subcontexts, newClassLoaderContext(sub, p.Subcontexts[sub]))
+		}
+	}
+
+	return clc
+}
+
+// usesLibs returns the list of unconditional libraries, in the order they were added, that
+// should be listed in the <uses-library> tags injected by manifest_fixer. Libraries nested under
+// a shared library are not included: a shared library advertises its own <uses-library>
+// requirements via its manifest, so redeclaring them in the dependent app's manifest would be
+// redundant (and can be outright wrong if the shared library is optional on some devices).
+func (m classLoaderContextMap) usesLibs() []string {
+	return usesLibsFor(m[AnySdkVersion])
+}
+
+func usesLibsFor(clcs []*ClassLoaderContext) []string {
+	var libs []string
+	for _, clc := range clcs {
+		libs = append(libs, clc.Name)
+		if !clc.IsSharedLibrary {
+			libs = append(libs, usesLibsFor(clc.Subcontexts)...)
+		}
+	}
+	return libs
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// excludeLibs returns a copy of this class loader context node with any of the given excluded
+// library names removed from its tree of subcontexts. The receiver is treated as read-only
+// (dependency-provided) input: it returns (nil, true) if this node itself is excluded,
+// (deepCopyWithoutExcluded, true) if some descendant had to be dropped, or (receiver, false) if
+// nothing changed, so that unaffected subtrees are shared by reference rather than copied.
+func (clc *ClassLoaderContext) excludeLibs(excluded []string) (*ClassLoaderContext, bool) {
+	if contains(excluded, clc.Name) {
+		return nil, true
+	}
+
+	changed := false
+	var subcontexts []*ClassLoaderContext
+	for _, sub := range clc.Subcontexts {
+		filtered, subChanged := sub.excludeLibs(excluded)
+		if subChanged {
+			changed = true
+		}
+		if filtered != nil {
+			subcontexts = append(subcontexts, filtered)
+		}
+	}
+
+	if !changed {
+		return clc, false
+	}
+
+	clcCopy := *clc
+	clcCopy.Subcontexts = subcontexts
+	return &clcCopy, true
+}
+
+// ExcludeLibs returns a copy of the class loader context map with the given libraries (and any
+// subcontexts nested underneath them) removed from every SDK-version bucket. This is used to
+// implement the `exclude_uses_libs` Blueprint property, which lets a module strip a
+// <uses-library> dependency pulled in by a prebuilt/AAR that does not actually exist on a given
+// target. SDK-version buckets and library subtrees that are not affected by the exclusion are
+// shared by reference with the original map; if no library is removed at all, the original map
+// itself is returned.
+func (m classLoaderContextMap) ExcludeLibs(excluded []string) classLoaderContextMap {
+	if len(excluded) == 0 {
+		return m
+	}
+
+	var result classLoaderContextMap
+	for sdkVer, clcs := range m {
+		var filtered []*ClassLoaderContext
+		bucketChanged := false
+		for _, clc := range clcs {
+			newClc, clcChanged := clc.excludeLibs(excluded)
+			if clcChanged {
+				bucketChanged = true
+			}
+			if newClc != nil {
+				filtered = append(filtered, newClc)
+			}
+		}
+
+		if bucketChanged {
+			if result == nil {
+				result = make(classLoaderContextMap, len(m))
+				for v, c := range m {
+					result[v] = c
+				}
+			}
+			result[sdkVer] = filtered
+		}
+	}
+
+	if result == nil {
+		return m
+	}
+	return result
+}
+
+// fixConditionalClassLoaderContext removes libraries from conditional (SDK-gated) class loader
+// contexts that are redundant: either because the same library is already present
+// unconditionally, or because a compatibility library is only needed in the presence of some
+// other library that turns out not to be used.
+func fixConditionalClassLoaderContext(m classLoaderContextMap) {
+	hasTestRunner := false
+	for _, clcs := range m {
+		for _, clc := range clcs {
+			if clc.Name == AndroidTestRunner {
+				hasTestRunner = true
+			}
+		}
+	}
+
+	unconditional := make(map[string]bool)
+	for _, clc := range m[AnySdkVersion] {
+		unconditional[clc.Name] = true
+	}
+
+	for sdkVer, clcs := range m {
+		if sdkVer == AnySdkVersion {
+			continue
+		}
+
+		var filtered []*ClassLoaderContext
+		for _, clc := range clcs {
+			if clc.Name == AndroidTestMock && !hasTestRunner {
+				continue
+			}
+			if unconditional[clc.Name] {
+				continue
+			}
+			filtered = append(filtered, clc)
+		}
+
+		if len(filtered) == 0 {
+			delete(m, sdkVer)
+		} else {
+			m[sdkVer] = filtered
+		}
+	}
+}
+
+// computeClassLoaderContext computes the "--host-context-for-sdk"/"--target-context-for-sdk"
+// dex2oat command line arguments for all the class loader contexts in the map, as well as the
+// flattened list of build paths that must be available for dexpreopt to run.
+func computeClassLoaderContext(ctx android.PathContext, m classLoaderContextMap) (string, android.Paths) {
+	var clcStr string
+	var paths android.Paths
+
+	sdkVers := make([]int, 0, len(m))
+	for sdkVer := range m {
+		sdkVers = append(sdkVers, sdkVer)
+	}
+	sort.Ints(sdkVers)
+
+	for _, sdkVer := range sdkVers {
+		clcs := m[sdkVer]
+		if len(clcs) == 0 {
+			continue
+		}
+
+		hostStr, targetStr, clcPaths := renderClassLoaderContexts(clcs)
+		paths = append(paths, clcPaths...)
+
+		sdkVerStr := "any"
+		if sdkVer != AnySdkVersion {
+			sdkVerStr = strconv.Itoa(sdkVer)
+		}
+
+		clcStr += fmt.Sprintf(" --host-context-for-sdk %s %s", sdkVerStr, hostStr)
+		clcStr += fmt.Sprintf(" --target-context-for-sdk %s %s", sdkVerStr, targetStr)
+	}
+
+	return clcStr, paths
+}
+
+// renderClassLoaderContexts renders a sibling list of class loader contexts as dex2oat's
+// "PCL[path]{PCL[child]#PCL[child2]}#PCL[path2]" grammar: siblings are separated by "#", and a
+// library's own nested subcontexts (if any) are enclosed in "{...}" right after its "PCL[...]"
+// entry. Build paths are gathered in the same DFS order.
+func renderClassLoaderContexts(clcs []*ClassLoaderContext) (hostStr, targetStr string, paths android.Paths) {
+	var hostParts, targetParts []string
+
+	for _, clc := range clcs {
+		hostEntry := fmt.Sprintf("PCL[%s]", clc.Host)
+		targetEntry := fmt.Sprintf("PCL[%s]", clc.Device)
+		paths = append(paths, clc.Host)
+
+		if len(clc.Subcontexts) > 0 {
+			subHostStr, subTargetStr, subPaths := renderClassLoaderContexts(clc.Subcontexts)
+			hostEntry += "{" + subHostStr + "}"
+			targetEntry += "{" + subTargetStr + "}"
+			paths = append(paths, subPaths...)
+		}
+
+		hostParts = append(hostParts, hostEntry)
+		targetParts = append(targetParts, targetEntry)
+	}
+
+	return strings.Join(hostParts, "#"), strings.Join(targetParts, "#"), paths
+}
+
+// ModuleConfig is the subset of a module's dexpreopt-relevant configuration needed to resolve
+// <uses-library> names to dex jar paths when building its class loader context.
+type ModuleConfig struct {
+	Name string
+
+	// LibraryPaths maps the name of each library this module may reference in a <uses-library>
+	// tag to the build/install paths of its dex jar.
+	LibraryPaths LibraryPaths
+}
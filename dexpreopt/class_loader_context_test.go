@@ -172,11 +172,163 @@ func TestCLC(t *testing.T) {
 	})
 }
 
+// Test that libraries nested under a shared library are dropped from usesLibs() (so that
+// manifest_fixer does not add redundant <uses-library> tags for them), while they still show up
+// in the computed dex2oat class loader context string and paths.
+func TestCLCSharedLibrary(t *testing.T) {
+	ctx := testContext()
+
+	m := make(classLoaderContextMap)
+	m[AnySdkVersion] = []*ClassLoaderContext{
+		{Name: "a", Host: buildPath(ctx, "a"), Device: "/system/a.jar"},
+		{
+			Name:            "shared",
+			Host:            buildPath(ctx, "shared"),
+			Device:          "/system/shared.jar",
+			IsSharedLibrary: true,
+			Subcontexts: []*ClassLoaderContext{
+				{Name: "shared_child1", Host: buildPath(ctx, "shared_child1"), Device: "/system/shared_child1.jar"},
+				{Name: "shared_child2", Host: buildPath(ctx, "shared_child2"), Device: "/system/shared_child2.jar"},
+			},
+		},
+	}
+
+	haveUsesLibs := m.usesLibs()
+	wantUsesLibs := []string{"a", "shared"}
+	if !reflect.DeepEqual(wantUsesLibs, haveUsesLibs) {
+		t.Errorf("\nwant uses libs: %s\nhave uses libs: %s", wantUsesLibs, haveUsesLibs)
+	}
+
+	haveStr, havePaths := computeClassLoaderContext(ctx, m)
+	for _, lib := range []string{"shared_child1", "shared_child2"} {
+		if !strings.Contains(haveStr, "PCL[out/"+lib+".jar]") {
+			t.Errorf("expected class loader context string to still contain %s:\n%s", lib, haveStr)
+		}
+	}
+
+	wantPaths := []string{"out/a.jar", "out/shared.jar", "out/shared_child1.jar", "out/shared_child2.jar"}
+	if !reflect.DeepEqual(wantPaths, havePaths.Strings()) {
+		t.Errorf("\nwant paths: %s\nhave paths: %s", wantPaths, havePaths)
+	}
+}
+
+// Test that a two-level class loader context tree (e.g. an AAR whose bundled static libs have
+// their own <uses-library> sets) renders as nested dex2oat "PCL[...]{...}" groups, while the
+// gathered build paths still contain the flattened transitive closure in DFS order.
+func TestCLCNestedSubcontexts(t *testing.T) {
+	ctx := testContext()
+
+	lp := make(LibraryPaths)
+
+	nested := make(LibraryPaths)
+	nested.AddLibraryPath(ctx, "child1", buildPath(ctx, "child1"), installPath(ctx, "child1"))
+	nested.AddLibraryPath(ctx, "child2", buildPath(ctx, "child2"), installPath(ctx, "child2"))
+
+	lp.AddLibraryPathWithSubcontexts(ctx, "parent", buildPath(ctx, "parent"), installPath(ctx, "parent"), nested)
+	lp.AddLibraryPath(ctx, "sibling", buildPath(ctx, "sibling"), installPath(ctx, "sibling"))
+
+	module := testSystemModuleConfig(ctx, "test")
+	module.LibraryPaths = lp
+
+	m := make(classLoaderContextMap)
+	ok, err := m.addLibs(ctx, AnySdkVersion, module, "parent", "sibling")
+	if !ok || err != nil {
+		t.Fatalf("addLibs failed: %s", err)
+	}
+
+	haveStr, havePaths := computeClassLoaderContext(ctx, m)
+
+	wantStr := " --host-context-for-sdk any " +
+		"PCL[out/parent.jar]{PCL[out/child1.jar]#PCL[out/child2.jar]}#PCL[out/sibling.jar]" +
+		" --target-context-for-sdk any " +
+		"PCL[/system/parent.jar]{PCL[/system/child1.jar]#PCL[/system/child2.jar]}#PCL[/system/sibling.jar]"
+	if wantStr != haveStr {
+		t.Errorf("\nwant class loader context: %s\nhave class loader context: %s", wantStr, haveStr)
+	}
+
+	wantPaths := []string{"out/parent.jar", "out/child1.jar", "out/child2.jar", "out/sibling.jar"}
+	if !reflect.DeepEqual(wantPaths, havePaths.Strings()) {
+		t.Errorf("\nwant paths: %s\nhave paths: %s", wantPaths, havePaths.Strings())
+	}
+}
+
+// Test ExcludeLibs, which strips libraries (and their subcontexts) that a prebuilt/AAR would
+// otherwise pull in but that don't actually exist on a given target.
+func TestCLCExcludeLibs(t *testing.T) {
+	ctx := testContext()
+
+	newCLC := func(name string, subcontexts ...*ClassLoaderContext) *ClassLoaderContext {
+		return &ClassLoaderContext{
+			Name:        name,
+			Host:        buildPath(ctx, name),
+			Device:      "/system/" + name + ".jar",
+			Subcontexts: subcontexts,
+		}
+	}
+
+	mapPointer := func(m classLoaderContextMap) uintptr {
+		return reflect.ValueOf(m).Pointer()
+	}
+
+	t.Run("exclude top-level lib", func(t *testing.T) {
+		m := classLoaderContextMap{AnySdkVersion: {newCLC("a"), newCLC("b")}}
+		got := m.ExcludeLibs([]string{"a"})
+		want := []string{"b"}
+		var have []string
+		for _, clc := range got[AnySdkVersion] {
+			have = append(have, clc.Name)
+		}
+		if !reflect.DeepEqual(want, have) {
+			t.Errorf("\nwant: %s\nhave: %s", want, have)
+		}
+	})
+
+	t.Run("exclude lib nested under a subcontext", func(t *testing.T) {
+		sibling := newCLC("sibling")
+		parent := newCLC("parent", newCLC("child"), sibling)
+		m := classLoaderContextMap{AnySdkVersion: {parent}}
+
+		got := m.ExcludeLibs([]string{"child"})
+
+		if len(got[AnySdkVersion]) != 1 || got[AnySdkVersion][0] == parent {
+			t.Errorf("expected parent to be deep-copied, got the same pointer or wrong length")
+		}
+		newParent := got[AnySdkVersion][0]
+		if len(newParent.Subcontexts) != 1 || newParent.Subcontexts[0].Name != "sibling" {
+			t.Errorf("expected only 'sibling' to remain under parent, got %+v", newParent.Subcontexts)
+		}
+		if newParent.Subcontexts[0] != sibling {
+			t.Errorf("expected unaffected sibling subtree to be shared by reference, got a copy")
+		}
+	})
+
+	t.Run("exclude compatibility lib gated by SDK level", func(t *testing.T) {
+		m := classLoaderContextMap{29: {newCLC(AndroidHidlManager), newCLC(AndroidHidlBase)}}
+		got := m.ExcludeLibs([]string{AndroidHidlManager})
+		want := []string{AndroidHidlBase}
+		var have []string
+		for _, clc := range got[29] {
+			have = append(have, clc.Name)
+		}
+		if !reflect.DeepEqual(want, have) {
+			t.Errorf("\nwant: %s\nhave: %s", want, have)
+		}
+	})
+
+	t.Run("exclude nothing", func(t *testing.T) {
+		m := classLoaderContextMap{AnySdkVersion: {newCLC("a"), newCLC("b")}}
+		got := m.ExcludeLibs([]string{"not-present"})
+		if mapPointer(got) != mapPointer(m) {
+			t.Errorf("expected map to be returned unchanged when nothing is excluded")
+		}
+	})
+}
+
 // Test that an unexpected unknown build path causes immediate error.
 func TestCLCUnknownBuildPath(t *testing.T) {
 	ctx := testContext()
 	lp := make(LibraryPaths)
-	err := lp.addLibraryPath(ctx, "a", nil, nil, true)
+	err := lp.addLibraryPath(ctx, "a", nil, nil, false, true)
 	checkError(t, err, "unknown build path to <uses-library> 'a'")
 }
 
@@ -184,7 +336,7 @@ func TestCLCUnknownBuildPath(t *testing.T) {
 func TestCLCUnknownInstallPath(t *testing.T) {
 	ctx := testContext()
 	lp := make(LibraryPaths)
-	err := lp.addLibraryPath(ctx, "a", buildPath(ctx, "a"), nil, true)
+	err := lp.addLibraryPath(ctx, "a", buildPath(ctx, "a"), nil, false, true)
 	checkError(t, err, "unknown install path to <uses-library> 'a'")
 }
 
@@ -222,4 +374,11 @@ func buildPath(ctx android.PathContext, lib string) android.Path {
 
 func installPath(ctx android.ModuleInstallPathContext, lib string) android.InstallPath {
 	return android.PathForModuleInstall(ctx, lib+".jar")
-}
\ No newline at end of file
+}
+
+func testSystemModuleConfig(ctx android.PathContext, name string) *ModuleConfig {
+	return &ModuleConfig{
+		Name:         name,
+		LibraryPaths: make(LibraryPaths),
+	}
+}